@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"io"
+
+	"github.com/yeka/zip"
+)
+
+// archivePassword, when set via --archive-password, both encrypts every
+// entry written to the output archive and is used to decrypt entries read
+// back out of an input archive produced the same way.
+var archivePassword string
+
+// legacyZipCrypto, when set via --legacy-zip-crypto, downgrades the output
+// archive's encryption from AES-256 to the legacy ZipCrypto ("Standard")
+// method for compatibility with tools that can't read AES-encrypted zips.
+// Has no effect unless archivePassword is also set.
+var legacyZipCrypto bool
+
+// createZipEntry starts a new entry in w, transparently encrypting it with
+// archivePassword when one is set.
+func createZipEntry(w *zip.Writer, name string) (io.Writer, error) {
+	if archivePassword == "" {
+		return w.Create(name)
+	}
+	method := zip.AES256Encryption
+	if legacyZipCrypto {
+		method = zip.StandardEncryption
+	}
+	return w.Encrypt(name, archivePassword, method)
+}
+
+// openZipEntry opens an entry from the input archive, supplying
+// archivePassword first if the entry was itself encrypted.
+func openZipEntry(file *zip.File) (io.ReadCloser, error) {
+	if archivePassword != "" && file.IsEncrypted() {
+		file.SetPassword(archivePassword)
+	}
+	return file.Open()
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/yeka/zip"
+)
+
+func TestCreateAndOpenZipEntryRoundTripsWithAES256(t *testing.T) {
+	defer resetArchiveCryptoFlags()
+	archivePassword = "hunter2"
+	legacyZipCrypto = false
+
+	roundTripZipEntry(t, "archive content")
+}
+
+func TestCreateAndOpenZipEntryRoundTripsWithLegacyZipCrypto(t *testing.T) {
+	defer resetArchiveCryptoFlags()
+	archivePassword = "hunter2"
+	legacyZipCrypto = true
+
+	roundTripZipEntry(t, "archive content")
+}
+
+func TestCreateZipEntryWritesPlaintextWithoutAPassword(t *testing.T) {
+	defer resetArchiveCryptoFlags()
+	archivePassword = ""
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	entry, err := createZipEntry(w, "plain.txt")
+	if err != nil {
+		t.Fatalf("createZipEntry failed: %v", err)
+	}
+	if _, err := entry.Write([]byte("no password")); err != nil {
+		t.Fatalf("failed to write entry: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read back archive: %v", err)
+	}
+	if r.File[0].IsEncrypted() {
+		t.Fatal("expected the entry to be unencrypted when no --archive-password was set")
+	}
+}
+
+func roundTripZipEntry(t *testing.T, content string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	entry, err := createZipEntry(w, "secret.txt")
+	if err != nil {
+		t.Fatalf("createZipEntry failed: %v", err)
+	}
+	if _, err := entry.Write([]byte(content)); err != nil {
+		t.Fatalf("failed to write entry: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read back archive: %v", err)
+	}
+	if len(r.File) != 1 {
+		t.Fatalf("expected 1 entry in archive, got %d", len(r.File))
+	}
+	if !r.File[0].IsEncrypted() {
+		t.Fatal("expected the entry to be encrypted when --archive-password was set")
+	}
+
+	rc, err := openZipEntry(r.File[0])
+	if err != nil {
+		t.Fatalf("openZipEntry failed: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read decrypted entry: %v", err)
+	}
+	if string(got) != content {
+		t.Fatalf("unexpected decrypted content: %q", got)
+	}
+}
+
+func resetArchiveCryptoFlags() {
+	archivePassword = ""
+	legacyZipCrypto = false
+}
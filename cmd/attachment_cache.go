@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheSidecar is the JSON file stored alongside a cached attachment,
+// recording enough to verify the cached bytes are still intact and to trace
+// them back to where they came from.
+type cacheSidecar struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Sha256     string `json:"sha256"`
+	UrlPrivate string `json:"url_private"`
+}
+
+func cacheEntryDir(cacheDir, id string) string {
+	return filepath.Join(cacheDir, id)
+}
+
+func cacheSidecarPath(cacheDir, id string) string {
+	return filepath.Join(cacheEntryDir(cacheDir, id), id+".json")
+}
+
+// findCachedAttachment looks for a previously downloaded copy of file.Id
+// under cacheDir and returns its path once the sidecar's recorded SHA-256
+// has been verified against the bytes on disk. A missing or corrupt cache
+// entry is treated as a cache miss so the caller falls back to downloading.
+func findCachedAttachment(cacheDir string, file *SlackFile) (string, bool) {
+	if cacheDir == "" || file.Id == "" {
+		return "", false
+	}
+
+	sidecarBytes, err := ioutil.ReadFile(cacheSidecarPath(cacheDir, file.Id))
+	if err != nil {
+		return "", false
+	}
+
+	var sidecar cacheSidecar
+	if err := json.Unmarshal(sidecarBytes, &sidecar); err != nil {
+		return "", false
+	}
+
+	path := filepath.Join(cacheEntryDir(cacheDir, file.Id), sidecar.Name)
+	if sha256File(path) != sidecar.Sha256 {
+		return "", false
+	}
+
+	if file.Name == "" {
+		file.Name = sidecar.Name
+	}
+
+	return path, true
+}
+
+// saveToCache writes a downloaded attachment's bytes into the cache
+// directory and records its SHA-256, URL and name in a sidecar file so a
+// later run can verify and reuse it via findCachedAttachment.
+func saveToCache(cacheDir string, job attachmentJob, body []byte) error {
+	if cacheDir == "" {
+		return nil
+	}
+
+	dir := cacheEntryDir(cacheDir, job.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, job.Name), body, 0644); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	sidecar := cacheSidecar{
+		Id:         job.ID,
+		Name:       job.Name,
+		Sha256:     hex.EncodeToString(sum[:]),
+		UrlPrivate: job.DownloadURL,
+	}
+	sidecarBytes, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cacheSidecarPath(cacheDir, job.ID), sidecarBytes, 0644)
+}
+
+// sha256File streams path through SHA-256 and returns the hex digest, or
+// "" if it can't be read.
+func sha256File(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
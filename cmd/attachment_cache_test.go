@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveToCacheThenFindCachedAttachment(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	job := attachmentJob{ID: "F1", Name: "report.pdf", DownloadURL: "https://slack.example/files/F1"}
+	body := []byte("pdf contents")
+
+	if err := saveToCache(cacheDir, job, body); err != nil {
+		t.Fatalf("saveToCache failed: %v", err)
+	}
+
+	file := &SlackFile{Id: "F1"}
+	path, ok := findCachedAttachment(cacheDir, file)
+	if !ok {
+		t.Fatal("expected cache hit after saveToCache")
+	}
+	if filepath.Base(path) != "report.pdf" {
+		t.Fatalf("unexpected cached path: %s", path)
+	}
+	if file.Name != "report.pdf" {
+		t.Fatalf("expected cache hit to fill in file name, got %q", file.Name)
+	}
+}
+
+func TestFindCachedAttachmentMissesOnCorruption(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	job := attachmentJob{ID: "F2", Name: "image.png", DownloadURL: "https://slack.example/files/F2"}
+	if err := saveToCache(cacheDir, job, []byte("original bytes")); err != nil {
+		t.Fatalf("saveToCache failed: %v", err)
+	}
+
+	corruptedPath := filepath.Join(cacheDir, "F2", "image.png")
+	if err := ioutil.WriteFile(corruptedPath, []byte("tampered bytes"), 0644); err != nil {
+		t.Fatalf("failed to tamper with cached file: %v", err)
+	}
+
+	if _, ok := findCachedAttachment(cacheDir, &SlackFile{Id: "F2"}); ok {
+		t.Fatal("expected cache miss once the cached file no longer matches its sidecar hash")
+	}
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yeka/zip"
+)
+
+// attachmentJob describes a single file attachment that needs to end up at
+// OutputPath inside the output archive, either by downloading it from
+// DownloadURL or by copying it from LocalPath if it was already resolved
+// against --attachments-dir.
+type attachmentJob struct {
+	ID          string
+	Name        string
+	DownloadURL string
+	OutputPath  string
+	LocalPath   string
+	Token       string
+	Size        int64
+}
+
+// attachmentResult is handed from a worker to the single writer goroutine
+// once a job's bytes have been resolved (or permanently failed).
+type attachmentResult struct {
+	job  attachmentJob
+	body []byte
+	err  error
+}
+
+// manifestEntry records the identity of one attachment written to the
+// output archive, so __uploads/manifest.json lets downstream tools (e.g. a
+// Mattermost import) verify integrity without re-hashing the whole zip.
+type manifestEntry struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// runAttachmentPipeline fans jobs out to concurrency workers (at least one), each
+// owning its own *http.Client, and serializes all writes back into w on a
+// single goroutine since archive/zip.Writer is not safe for concurrent use.
+// It returns a manifest entry for every attachment successfully written.
+func runAttachmentPipeline(w *zip.Writer, jobs []attachmentJob, concurrency, maxRetries int) []manifestEntry {
+	return runAttachmentPipelineWithProgress(w, jobs, concurrency, maxRetries, nil, "", nil)
+}
+
+// runAttachmentPipelineWithProgress is runAttachmentPipeline plus an
+// optional progress tracker, on-disk cache directory and --attachments-source
+// resolver chain; each may be left as its zero value to disable that
+// feature.
+func runAttachmentPipelineWithProgress(w *zip.Writer, jobs []attachmentJob, concurrency, maxRetries int, tracker *progressTracker, cacheDir string, resolvers []Resolver) []manifestEntry {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobsCh := make(chan attachmentJob)
+	resultsCh := make(chan attachmentResult)
+
+	var workers sync.WaitGroup
+	workers.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer workers.Done()
+			client := &http.Client{}
+			for job := range jobsCh {
+				resultsCh <- resolveAttachment(client, job, maxRetries, tracker, cacheDir, resolvers)
+			}
+		}()
+	}
+
+	manifestCh := make(chan []manifestEntry, 1)
+	go func() {
+		var manifest []manifestEntry
+		for result := range resultsCh {
+			if entry, ok := writeAttachmentResult(w, result); ok {
+				manifest = append(manifest, entry)
+			}
+			tracker.fileDone()
+		}
+		manifestCh <- manifest
+	}()
+
+	for _, job := range jobs {
+		jobsCh <- job
+	}
+	close(jobsCh)
+
+	workers.Wait()
+	close(resultsCh)
+	manifest := <-manifestCh
+	tracker.finish()
+	return manifest
+}
+
+// resolveAttachment first tries the --attachments-source resolver chain (if
+// any), then falls back to the legacy behavior: a job with no DownloadURL is
+// read from its LocalPath (a file already matched in --attachments-dir or
+// --cache-dir), and any other job is downloaded from its Slack URL with
+// retries. processChannelFile only sets LocalPath on jobs without a
+// DownloadURL, so a failed download is reported as an error rather than
+// served from disk. A body from the resolver chain or from a download is
+// saved into cacheDir (when set) so a later run can skip fetching it again,
+// regardless of which resolver produced it.
+func resolveAttachment(client *http.Client, job attachmentJob, maxRetries int, tracker *progressTracker, cacheDir string, resolvers []Resolver) attachmentResult {
+	tracker.fileStarted(job.Name)
+
+	if body, ok := resolveFromChain(client, tracker, resolvers, job); ok {
+		if err := saveToCache(cacheDir, job, body); err != nil {
+			log.Print("++++++ Failed to cache attachment: " + job.ID + "\n\n" + err.Error() + "\n")
+		}
+		return attachmentResult{job: job, body: body}
+	}
+
+	if job.DownloadURL == "" {
+		return readLocalAttachmentResult(job)
+	}
+
+	body, err := downloadWithRetry(client, job, maxRetries, tracker)
+	if err != nil {
+		log.Print("++++++ Download failed and no local attachment.: " + job.DownloadURL)
+		if job.LocalPath != "" {
+			return readLocalAttachmentResult(job)
+		}
+		return attachmentResult{job: job, err: err}
+	}
+
+	if err := saveToCache(cacheDir, job, body); err != nil {
+		log.Print("++++++ Failed to cache attachment: " + job.ID + "\n\n" + err.Error() + "\n")
+	}
+
+	return attachmentResult{job: job, body: body}
+}
+
+func readLocalAttachmentResult(job attachmentJob) attachmentResult {
+	if job.LocalPath == "" {
+		return attachmentResult{job: job, err: fmt.Errorf("no local attachment available for %s", job.ID)}
+	}
+	body, err := ioutil.ReadFile(job.LocalPath)
+	if err != nil {
+		log.Print("++++++ Failed to open the local file: " + job.LocalPath + "\n\n" + err.Error() + "\n")
+		return attachmentResult{job: job, err: err}
+	}
+	fmt.Printf("Use local file: %s (%s)\n", job.ID, job.LocalPath)
+	return attachmentResult{job: job, body: body}
+}
+
+// downloadWithRetry performs the HTTP GET for a job, retrying on 5xx/429 and
+// network errors with exponential backoff plus jitter. It honors a
+// Retry-After header when Slack sends one.
+func downloadWithRetry(client *http.Client, job attachmentJob, maxRetries int, tracker *progressTracker) ([]byte, error) {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var lastErr error
+	var retryAfter string
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoffDelay(attempt, retryAfter))
+			retryAfter = ""
+		}
+
+		req, err := http.NewRequest("GET", job.DownloadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if job.Token != "" {
+			req.Header.Add("Authorization", "Bearer "+job.Token)
+		}
+
+		response, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if response.StatusCode == http.StatusOK {
+			body, err := ioutil.ReadAll(&progressReader{Reader: response.Body, tracker: tracker})
+			response.Body.Close()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return body, nil
+		}
+
+		retryAfter = response.Header.Get("Retry-After")
+		response.Body.Close()
+
+		if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+			lastErr = fmt.Errorf("download of %s failed with status %d", job.DownloadURL, response.StatusCode)
+			continue
+		}
+
+		return nil, fmt.Errorf("download of %s failed with status %d", job.DownloadURL, response.StatusCode)
+	}
+
+	return nil, lastErr
+}
+
+// backoffDelay computes the exponential-backoff-with-jitter sleep before the
+// next retry attempt, honoring a Retry-After header when one was present on
+// the previous response.
+func backoffDelay(attempt int, retryAfter string) time.Duration {
+	if retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	base := time.Duration(1<<uint(attempt-1)) * 500 * time.Millisecond
+	jitter := time.Duration(rand.Int63n(int64(base) + 1))
+	return base + jitter
+}
+
+// writeManifest emits __uploads/manifest.json into the output archive,
+// listing every attachment's id, name, sha256 and byte count.
+func writeManifest(w *zip.Writer, manifest []manifestEntry) error {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	outFile, err := createZipEntry(w, "__uploads/manifest.json")
+	if err != nil {
+		return err
+	}
+
+	_, err = outFile.Write(manifestBytes)
+	return err
+}
+
+func writeAttachmentResult(w *zip.Writer, result attachmentResult) (manifestEntry, bool) {
+	if result.err != nil {
+		return manifestEntry{}, false
+	}
+
+	outFile, err := createZipEntry(w, result.job.OutputPath)
+	if err != nil {
+		log.Print("++++++ Failed to create output file in output archive: " + result.job.OutputPath + "\n\n" + err.Error() + "\n")
+		return manifestEntry{}, false
+	}
+
+	if _, err := outFile.Write(result.body); err != nil {
+		log.Print("++++++ Failed to write the downloaded file to the output archive: " + result.job.DownloadURL + "\n\n" + err.Error() + "\n")
+		return manifestEntry{}, false
+	}
+
+	fmt.Printf("Downloaded attachment into output archive: %s.\n", result.job.ID)
+
+	sum := sha256.Sum256(result.body)
+	return manifestEntry{
+		Id:     result.job.ID,
+		Name:   result.job.Name,
+		Sha256: hex.EncodeToString(sum[:]),
+		Bytes:  int64(len(result.body)),
+	}, true
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yeka/zip"
+)
+
+func TestDownloadWithRetryRecoversFromRateLimit(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempt := atomic.AddInt32(&attempts, 1)
+		if attempt < 3 {
+			rw.Header().Set("Retry-After", "0")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("file contents"))
+	}))
+	defer server.Close()
+
+	job := attachmentJob{
+		ID:          "F123",
+		Name:        "example.txt",
+		DownloadURL: server.URL,
+		OutputPath:  "__uploads/F123/example.txt",
+	}
+
+	body, err := downloadWithRetry(&http.Client{}, job, 4, nil)
+	if err != nil {
+		t.Fatalf("expected success after retries, got error: %v", err)
+	}
+	if string(body) != "file contents" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDownloadWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	job := attachmentJob{ID: "F456", Name: "example.txt", DownloadURL: server.URL}
+
+	_, err := downloadWithRetry(&http.Client{}, job, 2, nil)
+	if err == nil {
+		t.Fatal("expected an error after exhausting retries")
+	}
+}
+
+func TestRunAttachmentPipelineWritesSuccessfulDownloads(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("hello-" + req.URL.Path))
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	var jobs []attachmentJob
+	for i := 0; i < 5; i++ {
+		id := "F" + strconv.Itoa(i)
+		jobs = append(jobs, attachmentJob{
+			ID:          id,
+			Name:        "file.txt",
+			DownloadURL: server.URL + "/" + id,
+			OutputPath:  "__uploads/" + id + "/file.txt",
+		})
+	}
+
+	runAttachmentPipeline(w, jobs, 3, 2)
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read back archive: %v", err)
+	}
+	if len(reader.File) != len(jobs) {
+		t.Fatalf("expected %d entries in archive, got %d", len(jobs), len(reader.File))
+	}
+}
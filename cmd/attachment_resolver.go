@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Resolver is implemented by anything that can supply the bytes for an
+// attachment given its job metadata. Resolvers are tried in the order given
+// by --attachments-source, each falling through to the next on a miss so
+// attachments archived across several places (local disk, object storage,
+// the original Slack URL) can all be rebuilt from in one export. client is
+// the calling worker's *http.Client; the https resolver downloads through it
+// so connections are pooled the same way the legacy download path pools
+// them, while the s3 and gs resolvers use their own SDK clients. tracker is
+// the same *progressTracker the legacy path reports bytes to; the https, s3
+// and gs resolvers report downloaded bytes to it, the local and file
+// resolvers do not.
+type Resolver interface {
+	// Resolve returns an attachment's bytes, or ok=false if this resolver
+	// simply doesn't have it - that's a miss, not an error, and the caller
+	// should try the next resolver in the chain.
+	Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) (body []byte, ok bool, err error)
+}
+
+// ResolverFactory builds a Resolver from the spec string the user supplied
+// in --attachments-source, e.g. "s3://my-bucket/slack" or the bare word
+// "https".
+type ResolverFactory func(spec string) (Resolver, error)
+
+var resolverFactories = map[string]ResolverFactory{
+	"local": newLocalResolver,
+	"file":  newFileResolver,
+	"https": newHTTPSResolver,
+	"s3":    newS3Resolver,
+	"gs":    newGCSResolver,
+}
+
+// RegisterResolver adds a new --attachments-source scheme without the
+// caller needing to touch the main download loop.
+func RegisterResolver(scheme string, factory ResolverFactory) {
+	resolverFactories[scheme] = factory
+}
+
+// buildResolverChain parses a comma-separated --attachments-source value,
+// e.g. "local,s3://my-bucket/slack,https", into the ordered list of
+// resolvers processChannelFile's jobs should be tried against.
+func buildResolverChain(spec string) ([]Resolver, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var chain []Resolver
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		scheme := item
+		if idx := strings.Index(item, "://"); idx >= 0 {
+			scheme = item[:idx]
+		}
+
+		factory, ok := resolverFactories[scheme]
+		if !ok {
+			return nil, fmt.Errorf("unknown attachments-source scheme: %s", scheme)
+		}
+
+		resolver, err := factory(item)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure attachments-source %q: %s", item, err)
+		}
+		chain = append(chain, resolver)
+	}
+
+	return chain, nil
+}
+
+// resolveFromChain asks each resolver in turn for job's bytes and returns
+// the first hit. A resolver error is logged and treated like a miss so one
+// misbehaving source doesn't block the rest of the chain. client and
+// tracker are passed through to resolvers that need to make HTTP requests
+// or report download progress.
+func resolveFromChain(client *http.Client, tracker *progressTracker, chain []Resolver, job attachmentJob) ([]byte, bool) {
+	for _, resolver := range chain {
+		body, ok, err := resolver.Resolve(client, tracker, job)
+		if err != nil {
+			log.Print("++++++ Resolver error for " + job.ID + ": " + err.Error())
+			continue
+		}
+		if ok {
+			return body, true
+		}
+	}
+	return nil, false
+}
+
+// --- local: whatever --attachments-dir already points at ---
+
+type localResolver struct {
+	dir string
+}
+
+func newLocalResolver(spec string) (Resolver, error) {
+	return &localResolver{dir: localAttachmentsDir}, nil
+}
+
+func (r *localResolver) Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) ([]byte, bool, error) {
+	if r.dir == "" || job.ID == "" {
+		return nil, false, nil
+	}
+	localPath, err := findLocalAttachment(job.ID, r.dir)
+	if err != nil {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// --- file: an explicit directory given directly in the spec, e.g. file:///mnt/exports ---
+
+type fileResolver struct {
+	dir string
+}
+
+func newFileResolver(spec string) (Resolver, error) {
+	dir := strings.TrimPrefix(spec, "file://")
+	if dir == spec || dir == "" {
+		return nil, fmt.Errorf("expected a file:// URL, got %q", spec)
+	}
+	return &fileResolver{dir: dir}, nil
+}
+
+func (r *fileResolver) Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) ([]byte, bool, error) {
+	if job.ID == "" {
+		return nil, false, nil
+	}
+	localPath, err := findLocalAttachment(job.ID, r.dir)
+	if err != nil {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// --- https: the Slack-hosted URL already recorded on the job ---
+
+type httpsResolver struct{}
+
+func newHTTPSResolver(spec string) (Resolver, error) {
+	return &httpsResolver{}, nil
+}
+
+func (r *httpsResolver) Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) ([]byte, bool, error) {
+	if job.DownloadURL == "" {
+		return nil, false, nil
+	}
+	body, err := downloadWithRetry(client, job, maxDownloadRetries, tracker)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// --- s3: teams that archive attachments into S3 out-of-band ---
+
+type s3Resolver struct {
+	bucket string
+	prefix string
+	client *s3.S3
+}
+
+func newS3Resolver(spec string) (Resolver, error) {
+	bucket, prefix, err := parseBucketSpec(spec, "s3")
+	if err != nil {
+		return nil, err
+	}
+
+	// Credentials and region come from the standard AWS SDK env vars
+	// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_REGION, ...).
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Resolver{bucket: bucket, prefix: prefix, client: s3.New(sess)}, nil
+}
+
+func (r *s3Resolver) Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) ([]byte, bool, error) {
+	if job.ID == "" {
+		return nil, false, nil
+	}
+
+	out, err := r.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(path.Join(r.prefix, job.ID)),
+	})
+	if err != nil {
+		// Missing object is a miss, not a fatal error - fall through to the
+		// next resolver in the chain. Anything else (bad credentials, wrong
+		// bucket, throttling, network errors, ...) is a real error and must
+		// be surfaced rather than silently swallowed.
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer out.Body.Close()
+
+	body, err := ioutil.ReadAll(&progressReader{Reader: out.Body, tracker: tracker})
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// --- gs: the Google Cloud Storage equivalent of the S3 resolver ---
+
+type gcsResolver struct {
+	bucket string
+	prefix string
+	client *storage.Client
+}
+
+func newGCSResolver(spec string) (Resolver, error) {
+	bucket, prefix, err := parseBucketSpec(spec, "gs")
+	if err != nil {
+		return nil, err
+	}
+
+	// Credentials come from the standard GCP SDK env var
+	// (GOOGLE_APPLICATION_CREDENTIALS).
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsResolver{bucket: bucket, prefix: prefix, client: client}, nil
+}
+
+func (r *gcsResolver) Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) ([]byte, bool, error) {
+	if job.ID == "" {
+		return nil, false, nil
+	}
+
+	reader, err := r.client.Bucket(r.bucket).Object(path.Join(r.prefix, job.ID)).NewReader(context.Background())
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(&progressReader{Reader: reader, tracker: tracker})
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// parseBucketSpec turns "s3://my-bucket/slack" into ("my-bucket", "slack").
+func parseBucketSpec(spec, scheme string) (bucket, prefix string, err error) {
+	trimmed := strings.TrimPrefix(spec, scheme+"://")
+	if trimmed == spec {
+		return "", "", fmt.Errorf("expected a %s:// URL, got %q", scheme, spec)
+	}
+
+	parts := strings.SplitN(trimmed, "/", 2)
+	bucket = parts[0]
+	if bucket == "" {
+		return "", "", fmt.Errorf("%s:// URL is missing a bucket name: %q", scheme, spec)
+	}
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+	return bucket, prefix, nil
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseBucketSpec(t *testing.T) {
+	tests := []struct {
+		spec       string
+		scheme     string
+		wantBucket string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{spec: "s3://my-bucket/slack", scheme: "s3", wantBucket: "my-bucket", wantPrefix: "slack"},
+		{spec: "s3://my-bucket", scheme: "s3", wantBucket: "my-bucket", wantPrefix: ""},
+		{spec: "gs://my-bucket/a/b", scheme: "gs", wantBucket: "my-bucket", wantPrefix: "a/b"},
+		{spec: "s3:///slack", scheme: "s3", wantErr: true},
+		{spec: "https://example.com", scheme: "s3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		bucket, prefix, err := parseBucketSpec(tt.spec, tt.scheme)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBucketSpec(%q, %q): expected an error, got none", tt.spec, tt.scheme)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBucketSpec(%q, %q): unexpected error: %v", tt.spec, tt.scheme, err)
+			continue
+		}
+		if bucket != tt.wantBucket || prefix != tt.wantPrefix {
+			t.Errorf("parseBucketSpec(%q, %q) = (%q, %q), want (%q, %q)", tt.spec, tt.scheme, bucket, prefix, tt.wantBucket, tt.wantPrefix)
+		}
+	}
+}
+
+func TestBuildResolverChainUnknownScheme(t *testing.T) {
+	if _, err := buildResolverChain("local,bogus"); err == nil {
+		t.Fatal("expected an error for an unknown attachments-source scheme")
+	}
+}
+
+func TestBuildResolverChainEmptySpec(t *testing.T) {
+	chain, err := buildResolverChain("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if chain != nil {
+		t.Fatalf("expected a nil chain for an empty spec, got %v", chain)
+	}
+}
+
+// fakeResolver is a test double that either misses, hits with a fixed body,
+// or errors, so resolveFromChain's fallthrough logic can be exercised
+// without touching the network.
+type fakeResolver struct {
+	body []byte
+	ok   bool
+	err  error
+}
+
+func (r *fakeResolver) Resolve(client *http.Client, tracker *progressTracker, job attachmentJob) ([]byte, bool, error) {
+	return r.body, r.ok, r.err
+}
+
+func TestResolveFromChainFallsThroughOnMiss(t *testing.T) {
+	chain := []Resolver{
+		&fakeResolver{ok: false},
+		&fakeResolver{body: []byte("from second resolver"), ok: true},
+		&fakeResolver{body: []byte("should never be reached"), ok: true},
+	}
+
+	body, ok := resolveFromChain(&http.Client{}, nil, chain, attachmentJob{ID: "F1"})
+	if !ok {
+		t.Fatal("expected a hit from the second resolver in the chain")
+	}
+	if string(body) != "from second resolver" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestResolveFromChainSkipsErroringResolver(t *testing.T) {
+	chain := []Resolver{
+		&fakeResolver{err: errBoom},
+		&fakeResolver{body: []byte("recovered"), ok: true},
+	}
+
+	body, ok := resolveFromChain(&http.Client{}, nil, chain, attachmentJob{ID: "F1"})
+	if !ok {
+		t.Fatal("expected a hit from the resolver after the erroring one")
+	}
+	if string(body) != "recovered" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestResolveFromChainAllMiss(t *testing.T) {
+	chain := []Resolver{
+		&fakeResolver{ok: false},
+		&fakeResolver{ok: false},
+	}
+
+	if _, ok := resolveFromChain(&http.Client{}, nil, chain, attachmentJob{ID: "F1"}); ok {
+		t.Fatal("expected no hit when every resolver in the chain misses")
+	}
+}
+
+var errBoom = &fakeErr{"boom"}
+
+type fakeErr struct{ msg string }
+
+func (e *fakeErr) Error() string { return e.msg }
@@ -1,25 +1,29 @@
 package cmd
 
 import (
-	"archive/zip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/yeka/zip"
 )
 
 var (
 	attachmentsApiToken string
 	localAttachmentsDir string
+	downloadConcurrency int
+	maxDownloadRetries  int
+	noProgress          bool
+	attachmentsCacheDir string
+	attachmentsSource   string
 )
 
 var fetchAttachmentsCmd = &cobra.Command{
@@ -31,9 +35,25 @@ var fetchAttachmentsCmd = &cobra.Command{
 func init() {
 	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsApiToken, "api-token", "", "Slack API token. Can be obtained here: https://api.slack.com/docs/oauth-test-tokens")
 	fetchAttachmentsCmd.PersistentFlags().StringVar(&localAttachmentsDir, "attachments-dir", "", "Local directory containing downloaded attachments")
+	fetchAttachmentsCmd.PersistentFlags().IntVar(&downloadConcurrency, "concurrency", 8, "Number of attachments to download concurrently")
+	fetchAttachmentsCmd.PersistentFlags().IntVar(&maxDownloadRetries, "max-retries", 4, "Maximum number of retries for a failed attachment download")
+	fetchAttachmentsCmd.PersistentFlags().BoolVar(&noProgress, "no-progress", false, "Disable the attachment download progress bar")
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsCacheDir, "cache-dir", "", "Directory to cache downloaded attachments in, keyed by file ID, so re-running fetch-attachments skips already-fetched files")
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&archivePassword, "archive-password", "", "Password to AES-256 encrypt the output archive with. The input archive is decrypted with the same password if it was produced with this flag.")
+	fetchAttachmentsCmd.PersistentFlags().BoolVar(&legacyZipCrypto, "legacy-zip-crypto", false, "Use legacy ZipCrypto instead of AES-256 for --archive-password, for tools that can't read AES-encrypted zips. Ignored unless --archive-password is set.")
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsSource, "attachments-source", "", "Comma-separated priority list of where to look for attachments, e.g. \"local,s3://my-bucket/slack,https\". Schemes: local, file://, https, s3://bucket/prefix, gs://bucket/prefix")
 }
 
 func fetchAttachments(cmd *cobra.Command, args []string) error {
+	// Parse --attachments-source into the ordered list of resolvers each
+	// attachment is tried against before falling back to the legacy
+	// --attachments-dir / --cache-dir / Slack URL download path below.
+	resolvers, err := buildResolverChain(attachmentsSource)
+	if err != nil {
+		fmt.Printf("Invalid --attachments-source: %s\n", err)
+		os.Exit(1)
+	}
+
 	// Open the input archive.
 	r, err := zip.OpenReader(inputArchive)
 	if err != nil {
@@ -53,44 +73,57 @@ func fetchAttachments(cmd *cobra.Command, args []string) error {
 	// Create a zip writer on the output archive.
 	w := zip.NewWriter(f)
 
+	// Jobs collected while walking the channel JSON files below, downloaded
+	// and written to the output archive in one pipeline pass at the end.
+	var jobs []attachmentJob
+
 	// Run through all the files in the input archive.
 	for _, file := range r.File {
 		verbosePrintln(fmt.Sprintf("Processing file: %s\n", file.Name))
 
 		// Open the file from the input archive.
-		inReader, err := file.Open()
+		inReader, err := openZipEntry(file)
 		if err != nil {
 			fmt.Printf("Failed to open file in input archive: %s\n\n%s", file.Name, err)
 			os.Exit(1)
 		}
 
-		// Read the file into a byte array.
-		inBuf, err := ioutil.ReadAll(inReader)
-		if err != nil {
-			fmt.Printf("Failed to read file in input archive: %s\n\n%s", file.Name, err)
-		}
-
-		// Now write this file to the output archive.
-		outFile, err := w.Create(file.Name)
+		// Now create this file in the output archive.
+		outFile, err := createZipEntry(w, file.Name)
 		if err != nil {
 			fmt.Printf("Failed to create file in output archive: %s\n\n%s", file.Name, err)
 			os.Exit(1)
 		}
-		_, err = outFile.Write(inBuf)
-		if err != nil {
-			fmt.Printf("Failed to write file in output archive: %s\n\n%s", file.Name, err)
-		}
 
 		// Check if the file name matches the pattern for files we need to parse.
 		splits := strings.Split(file.Name, "/")
 		if len(splits) == 2 && !strings.HasPrefix(splits[0], "__") && strings.HasSuffix(splits[1], ".json") {
-			// Parse this file.
-			err = processChannelFile(w, file, inBuf, attachmentsApiToken)
+			// Tee the raw bytes into the output archive as the streaming JSON
+			// decoder below consumes them, so we never hold the whole file in
+			// memory just to copy it through unchanged.
+			fileJobs, err := processChannelFile(file.Name, io.TeeReader(inReader, outFile), attachmentsApiToken)
 			if err != nil {
 				fmt.Printf("%s", err)
 				os.Exit(1)
 			}
+			jobs = append(jobs, fileJobs...)
+		} else {
+			// Not a channel file we need to parse; stream it straight through.
+			if _, err := io.Copy(outFile, inReader); err != nil {
+				fmt.Printf("Failed to write file in output archive: %s\n\n%s", file.Name, err)
+			}
 		}
+
+		inReader.Close()
+	}
+
+	// Download every collected attachment through a bounded worker pool and
+	// write the results back into the output archive.
+	tracker := newProgressTracker(jobs, noProgress)
+	manifest := runAttachmentPipelineWithProgress(w, jobs, downloadConcurrency, maxDownloadRetries, tracker, attachmentsCacheDir, resolvers)
+
+	if err := writeManifest(w, manifest); err != nil {
+		fmt.Printf("Failed to write attachment manifest.\n\n%s", err)
 	}
 
 	// Close the output zip writer.
@@ -102,17 +135,30 @@ func fetchAttachments(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token string) error {
+// processChannelFile streams a channel JSON file's post array one post at a
+// time (rather than unmarshaling it into one big []SlackPost) and builds the
+// list of attachment jobs it references. Actual downloading happens later,
+// in runAttachmentPipeline, so the attachments of every channel file can be
+// downloaded concurrently. fileName is used for error messages only; r is read exactly
+// once, so the caller is responsible for teeing it into the output archive.
+func processChannelFile(fileName string, r io.Reader, token string) ([]attachmentJob, error) {
 	verbosePrintln("This is a 'channels' file. Examining it's contents for attachments.")
 
-	// Parse the JSON of the file.
-	var posts []SlackPost
-	if err := json.Unmarshal(inBuf, &posts); err != nil {
-		return errors.New("Couldn't parse the JSON file: " + file.Name + "\n\n" + err.Error() + "\n")
+	decoder := json.NewDecoder(r)
+
+	// Consume the opening '[' of the post array.
+	if _, err := decoder.Token(); err != nil {
+		return nil, errors.New("Couldn't parse the JSON file: " + fileName + "\n\n" + err.Error() + "\n")
 	}
 
-	// Loop through all the posts.
-	for _, post := range posts {
+	var jobs []attachmentJob
+
+	// Loop through all the posts, one array element at a time.
+	for decoder.More() {
+		var post SlackPost
+		if err := decoder.Decode(&post); err != nil {
+			return nil, errors.New("Couldn't parse the JSON file: " + fileName + "\n\n" + err.Error() + "\n")
+		}
 		// Support for legacy file_share posts.
 		if post.Subtype == "file_share" {
 			// Check there's a File property.
@@ -130,8 +176,6 @@ func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token strin
 			continue
 		}
 
-		client := &http.Client{}
-
 		// Loop through all the files.
 		for _, file := range post.Files {
 			log.Print("\n")
@@ -142,14 +186,14 @@ func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token strin
 				localFilePath, err = findLocalAttachment(file.Id, localAttachmentsDir)
 				if err == nil {
 					if len(file.Name) < 1 {
-						fileName := filepath.Base(localFilePath)
+						baseName := filepath.Base(localFilePath)
 						prefix := file.Id + "-"
-						if strings.HasPrefix(fileName, prefix) {
-							fileName = strings.TrimPrefix(fileName, prefix)
+						if strings.HasPrefix(baseName, prefix) {
+							baseName = strings.TrimPrefix(baseName, prefix)
 						}
 						// Replace spaces and special characters with underscores, but keep the file extension.
-						ext := filepath.Ext(fileName)
-						fileNameWithoutExt := strings.TrimSuffix(fileName, ext)
+						ext := filepath.Ext(baseName)
+						fileNameWithoutExt := strings.TrimSuffix(baseName, ext)
 						reg := regexp.MustCompile(`[[:space:][:punct:]]`)
 						fileNameWithoutExt = reg.ReplaceAllString(fileNameWithoutExt, "_")
 						file.Name = fileNameWithoutExt + ext
@@ -157,6 +201,12 @@ func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token strin
 					log.Print("++++++ Find local attachments: " + file.Id)
 				}
 			}
+			if localFilePath == "" && attachmentsCacheDir != "" {
+				if cachedPath, ok := findCachedAttachment(attachmentsCacheDir, file); ok {
+					localFilePath = cachedPath
+					log.Print("++++++ Found cached attachment: " + file.Id)
+				}
+			}
 			log.Print("++++++ Local file path: " + localFilePath)
 
 			if localFilePath == "" {
@@ -169,67 +219,42 @@ func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token strin
 
 			// Figure out the download URL to use.
 			var downloadUrl string
-			if len(file.UrlPrivateDownload) > 0 {
-				downloadUrl = file.UrlPrivateDownload
-			} else {
-				downloadUrl = file.UrlPrivate
-			}
-
-			// Build the output file path.
-			outputPath := "__uploads/" + file.Id + "/" + file.Name
-
-			// Create the file in the zip output file.
-			outFile, err := w.Create(outputPath)
-			if err != nil {
-				log.Print("++++++ Failed to create output file in output archive: " + outputPath + "\n\n" + err.Error() + "\n")
-				continue
-			}
-
-			verbosePrintln(fmt.Sprintf("Downloading file %s (%s)", file.Id, file.Name))
-
-			// Fetch the file.
-			req, err := http.NewRequest("GET", downloadUrl, nil)
-			if err != nil {
-				log.Print("++++++ Failed to create file download request: " + downloadUrl)
-				continue
-			}
-			if token != "" {
-				req.Header.Add("Authorization", "Bearer "+token)
-			}
-			response, err := client.Do(req)
-			if err != nil || response.StatusCode != http.StatusOK {
-				// 先尝试本地文件
-				if localFilePath, err := findLocalAttachment(file.Id, localAttachmentsDir); err == nil {
-					localFile, err := os.Open(localFilePath)
-					if err != nil {
-						log.Print("++++++ Failed to open the local file: " + localFilePath + "\n\n" + err.Error() + "\n")
-						continue
-					}
-					defer localFile.Close()
-					_, err = io.Copy(outFile, localFile)
-					if err == nil {
-						fmt.Printf("Use local file: %s (%s)\n", file.Id, localFilePath)
-						continue
-					}
+			if localFilePath == "" {
+				if len(file.UrlPrivateDownload) > 0 {
+					downloadUrl = file.UrlPrivateDownload
+				} else {
+					downloadUrl = file.UrlPrivate
 				}
-
-				log.Print("++++++ Download failed and no local attachment.: " + downloadUrl)
-				continue
-			}
-			defer response.Body.Close()
-
-			// Save the file to the output zip file.
-			_, err = io.Copy(outFile, response.Body)
-			if err != nil {
-				log.Print("++++++ Failed to write the downloaded file to the output archive: " + downloadUrl + "\n\n" + err.Error() + "\n")
 			}
 
-			// Success at last.
-			fmt.Printf("Downloaded attachment into output archive: %s.\n", file.Id)
+			verbosePrintln(fmt.Sprintf("Queuing file %s (%s)", file.Id, file.Name))
+
+			jobs = append(jobs, attachmentJob{
+				ID:          file.Id,
+				Name:        file.Name,
+				DownloadURL: downloadUrl,
+				OutputPath:  "__uploads/" + file.Id + "/" + file.Name,
+				LocalPath:   localFilePath,
+				Token:       token,
+				Size:        file.Size,
+			})
 		}
 	}
 
-	return nil
+	// Consume the closing ']'.
+	if _, err := decoder.Token(); err != nil {
+		return nil, errors.New("Couldn't parse the JSON file: " + fileName + "\n\n" + err.Error() + "\n")
+	}
+
+	// The decoder only tees the bytes it actually reads, and it can stop
+	// short of EOF once the closing ']' is parsed, leaving any trailing
+	// bytes un-teed. Drain the rest of r so the output archive's copy of
+	// this file is always byte-identical to the input.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, errors.New("Couldn't parse the JSON file: " + fileName + "\n\n" + err.Error() + "\n")
+	}
+
+	return jobs, nil
 }
 
 func findLocalAttachment(fileID, dir string) (string, error) {
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// progressTracker renders an aggregate "X of Y attachments, Z MB / total MB"
+// line to stderr as attachments are downloaded. A nil tracker, or one
+// created with enabled=false, is a silent no-op so callers don't need to
+// branch on whether progress reporting is on.
+type progressTracker struct {
+	mu          sync.Mutex
+	enabled     bool
+	totalFiles  int
+	doneFiles   int
+	totalBytes  int64
+	doneBytes   int64
+	currentName string
+}
+
+// newProgressTracker pre-scans jobs to total up the file count and byte
+// count up front, so the bar can show a meaningful total from the first
+// line printed. Progress is disabled when noProgress is set or stderr isn't
+// a terminal.
+func newProgressTracker(jobs []attachmentJob, noProgress bool) *progressTracker {
+	var totalBytes int64
+	for _, job := range jobs {
+		totalBytes += job.Size
+	}
+
+	return &progressTracker{
+		enabled:    !noProgress && isTerminal(os.Stderr),
+		totalFiles: len(jobs),
+		totalBytes: totalBytes,
+	}
+}
+
+func (t *progressTracker) fileStarted(name string) {
+	if t == nil || !t.enabled {
+		return
+	}
+	t.mu.Lock()
+	t.currentName = name
+	t.mu.Unlock()
+	t.render()
+}
+
+func (t *progressTracker) addBytes(n int64) {
+	if t == nil || !t.enabled {
+		return
+	}
+	t.mu.Lock()
+	t.doneBytes += n
+	t.mu.Unlock()
+	t.render()
+}
+
+func (t *progressTracker) fileDone() {
+	if t == nil || !t.enabled {
+		return
+	}
+	t.mu.Lock()
+	t.doneFiles++
+	t.mu.Unlock()
+	t.render()
+}
+
+func (t *progressTracker) render() {
+	t.mu.Lock()
+	line := fmt.Sprintf("Downloading %s: %d of %d attachments, %.1f MB / %.1f MB",
+		t.currentName, t.doneFiles, t.totalFiles, float64(t.doneBytes)/1e6, float64(t.totalBytes)/1e6)
+	t.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "\r%-100s", line)
+}
+
+func (t *progressTracker) finish() {
+	if t == nil || !t.enabled {
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// progressReader wraps an io.Reader and adds every chunk read to a
+// progressTracker's aggregate byte count as a download streams in. No
+// per-file byte count is kept; the progress line shows only the name of the
+// most recently started file next to the aggregate totals.
+type progressReader struct {
+	io.Reader
+	tracker *progressTracker
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if n > 0 {
+		p.tracker.addBytes(int64(n))
+	}
+	return n, err
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return (stat.Mode() & os.ModeCharDevice) != 0
+}